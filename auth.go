@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// httpProxyPrincipal is what an Auth implementation resolves a request to.
+// An empty ACL means the principal may target any devid.
+type httpProxyPrincipal struct {
+	name string
+	acl  []string
+}
+
+func (p *httpProxyPrincipal) allowed(devid string) bool {
+	if len(p.acl) == 0 {
+		return true
+	}
+
+	for _, id := range p.acl {
+		if id == devid {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Auth authenticates a request to httpProxyRedirect, or a devid/token pair
+// presented out-of-band (e.g. SOCKS5 username/password auth via
+// AuthenticateToken). Authenticate is responsible for writing whatever
+// status/headers are appropriate when credentials are missing or invalid
+// (e.g. 407 + WWW-Authenticate).
+type Auth interface {
+	Authenticate(c *gin.Context) (*httpProxyPrincipal, bool)
+	AuthenticateToken(devid, token string) (*httpProxyPrincipal, bool)
+}
+
+// httpProxyAuth is the Auth implementation configured via cfg.HttpProxyAuth,
+// consulted by httpProxyRedirect; the principal it returns is bound to the
+// sid in httpProxyPrincipals and re-checked on the raw TCP path in
+// doHttpProxy.
+var httpProxyAuth Auth = noneAuth{}
+
+// httpProxyPrincipals binds a sid (as created by httpProxyRedirect) to the
+// principal that was authenticated for it, so doHttpProxy can re-check the
+// ACL without re-running the Auth implementation.
+var httpProxyPrincipals sync.Map
+
+// initHttpProxyAuth parses cfg.HttpProxyAuth, a "kind:rest" URI such as
+// "basic:/etc/rttys/htpasswd", "static:s3cr3t" or "hmac:s3cr3t", and installs
+// the resulting Auth implementation. An empty value keeps the default
+// noneAuth, preserving the historical "any devid is reachable" behavior.
+func initHttpProxyAuth(cfg string) error {
+	if cfg == "" {
+		httpProxyAuth = noneAuth{}
+		return nil
+	}
+
+	kind, rest, ok := strings.Cut(cfg, ":")
+	if !ok {
+		return errors.New("invalid HttpProxyAuth: expected \"kind:config\"")
+	}
+
+	var auth Auth
+	var err error
+
+	switch kind {
+	case "none":
+		auth = noneAuth{}
+	case "static":
+		auth = &staticAuth{token: rest}
+	case "basic":
+		auth, err = newBasicAuth(rest)
+	case "hmac":
+		auth = &hmacAuth{secret: []byte(rest)}
+	default:
+		return errors.New("unknown HttpProxyAuth kind: " + kind)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	httpProxyAuth = auth
+
+	return nil
+}
+
+// noneAuth is the default: every request is allowed, with no ACL.
+type noneAuth struct{}
+
+func (noneAuth) Authenticate(c *gin.Context) (*httpProxyPrincipal, bool) {
+	return &httpProxyPrincipal{name: "anonymous"}, true
+}
+
+func (noneAuth) AuthenticateToken(devid, token string) (*httpProxyPrincipal, bool) {
+	return &httpProxyPrincipal{name: "anonymous"}, true
+}
+
+// staticAuth checks a single bearer token shared by all callers.
+type staticAuth struct {
+	token string
+}
+
+func (a *staticAuth) Authenticate(c *gin.Context) (*httpProxyPrincipal, bool) {
+	hdr := c.GetHeader("Authorization")
+	want := "Bearer " + a.token
+
+	if a.token == "" || subtle.ConstantTimeCompare([]byte(hdr), []byte(want)) != 1 {
+		c.Header("WWW-Authenticate", `Bearer realm="rttys"`)
+		c.Status(http.StatusUnauthorized)
+		return nil, false
+	}
+
+	return &httpProxyPrincipal{name: "static"}, true
+}
+
+func (a *staticAuth) AuthenticateToken(devid, token string) (*httpProxyPrincipal, bool) {
+	if a.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+		return nil, false
+	}
+
+	return &httpProxyPrincipal{name: "static"}, true
+}
+
+// basicAuth validates HTTP Basic credentials against a htpasswd-style file:
+// one "user:bcryptHash" or "user:bcryptHash:devid,devid" entry per line.
+type basicAuth struct {
+	users map[string]string   // user -> bcrypt hash
+	acls  map[string][]string // user -> allowed devids
+}
+
+func newBasicAuth(path string) (*basicAuth, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	a := &basicAuth{users: map[string]string{}, acls: map[string][]string{}}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) < 2 {
+			continue
+		}
+
+		a.users[parts[0]] = parts[1]
+		if len(parts) == 3 && parts[2] != "" {
+			a.acls[parts[0]] = strings.Split(parts[2], ",")
+		}
+	}
+
+	return a, scanner.Err()
+}
+
+func (a *basicAuth) Authenticate(c *gin.Context) (*httpProxyPrincipal, bool) {
+	user, pass, ok := c.Request.BasicAuth()
+	if ok {
+		hash, exists := a.users[user]
+		if exists && bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil {
+			return &httpProxyPrincipal{name: user, acl: a.acls[user]}, true
+		}
+	}
+
+	c.Header("WWW-Authenticate", `Basic realm="rttys"`)
+	c.Status(http.StatusProxyAuthRequired)
+
+	return nil, false
+}
+
+// AuthenticateToken expects token in "user:password" form, as used by the
+// SOCKS5 gateway's username/password auth.
+func (a *basicAuth) AuthenticateToken(devid, token string) (*httpProxyPrincipal, bool) {
+	user, pass, ok := strings.Cut(token, ":")
+	if !ok {
+		return nil, false
+	}
+
+	hash, exists := a.users[user]
+	if !exists || bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) != nil {
+		return nil, false
+	}
+
+	return &httpProxyPrincipal{name: user, acl: a.acls[user]}, true
+}
+
+// hmacAuth validates signed URLs: ?expires=<unix>&sig=hex(hmac-sha256(devid
+// + "|" + expires)), so links can be shared without an interactive prompt.
+type hmacAuth struct {
+	secret []byte
+}
+
+func (a *hmacAuth) Authenticate(c *gin.Context) (*httpProxyPrincipal, bool) {
+	devid := c.Param("devid")
+
+	if !a.verify(devid, c.Query("expires"), c.Query("sig")) {
+		c.Status(http.StatusUnauthorized)
+		return nil, false
+	}
+
+	return &httpProxyPrincipal{name: "hmac:" + devid, acl: []string{devid}}, true
+}
+
+// AuthenticateToken expects token in "expires:sig" form, as used by the
+// SOCKS5 gateway's username/password auth (username carries the devid).
+func (a *hmacAuth) AuthenticateToken(devid, token string) (*httpProxyPrincipal, bool) {
+	expiresStr, sig, ok := strings.Cut(token, ":")
+	if !ok || !a.verify(devid, expiresStr, sig) {
+		return nil, false
+	}
+
+	return &httpProxyPrincipal{name: "hmac:" + devid, acl: []string{devid}}, true
+}
+
+func (a *hmacAuth) verify(devid, expiresStr, sig string) bool {
+	expires, err := strconv.ParseInt(expiresStr, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(devid + "|" + expiresStr))
+	expected := mac.Sum(nil)
+
+	got, err := hex.DecodeString(sig)
+	if err != nil || subtle.ConstantTimeCompare(got, expected) != 1 {
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// redactedHeaders are stripped from captured requests by default, since the
+// capture API is essentially a MITM logger and operators shouldn't be able
+// to lift live credentials out of it.
+var redactedHeaders = []string{"Cookie", "Authorization"}
+
+type captureEntry struct {
+	Index     int       `json:"index"`
+	DestAddr  string    `json:"destAddr"`
+	Time      time.Time `json:"time"`
+	Req       []byte    `json:"-"`
+	Resp      []byte    `json:"-"`
+	ring      *captureRing
+	evicted   bool   // true once the ring has dropped this entry from r.entries
+	reqMethod string // the request's method, so responseComplete can tell e.g. HEAD apart from GET
+}
+
+// captureRing is a bounded, per-session ring buffer of request/response
+// pairs seen by doHttpProxy.
+type captureRing struct {
+	mu         sync.Mutex
+	entries    []*captureEntry
+	nextIndex  int
+	totalBytes int
+	maxCount   int
+	maxBytes   int
+}
+
+const httpProxyCaptureMaxBytes = 10 << 20 // 10MiB of captured req+resp data per session
+
+var proxyCaptures sync.Map // sid -> *captureRing
+
+// pendingCaptures holds, per client src addr, the capture entries still
+// waiting for their response on that connection, oldest first. A keep-alive
+// or pipelined connection may have several requests recorded before the
+// response to the first of them arrives, so a single-slot map would
+// mis-attribute a late response to whichever request was recorded last; a
+// FIFO queue keeps each entry bound to the request it actually belongs to.
+var pendingCaptures sync.Map // string(srcAddr) -> *pendingCaptureQueue
+
+type pendingCaptureQueue struct {
+	mu      sync.Mutex
+	entries []*captureEntry
+}
+
+// trackPendingCapture registers entry as awaiting a response on srcAddr.
+func trackPendingCapture(srcAddr []byte, entry *captureEntry) {
+	v, _ := pendingCaptures.LoadOrStore(string(srcAddr), &pendingCaptureQueue{})
+	q := v.(*pendingCaptureQueue)
+
+	q.mu.Lock()
+	q.entries = append(q.entries, entry)
+	q.mu.Unlock()
+}
+
+// clearPendingCaptures drops any capture entries still queued for srcAddr,
+// called once the proxy connection for srcAddr is torn down.
+func clearPendingCaptures(srcAddr []byte) {
+	pendingCaptures.Delete(string(srcAddr))
+}
+
+// recordResponse appends data written back to a proxied client to the oldest
+// capture entry still pending a response on that client's src addr, popping
+// it off the queue once a full HTTP response has been accumulated.
+func recordResponse(srcAddr []byte, data []byte) {
+	v, ok := pendingCaptures.Load(string(srcAddr))
+	if !ok {
+		return
+	}
+
+	q := v.(*pendingCaptureQueue)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.entries) == 0 {
+		return
+	}
+
+	entry := q.entries[0]
+	entry.appendResponse(data)
+
+	if responseComplete(entry.Resp, entry.reqMethod) {
+		q.entries = q.entries[1:]
+	}
+}
+
+// completePendingCapture unconditionally pops the oldest capture entry still
+// pending a response on srcAddr, for the connection-close-delimited case:
+// handleHttpProxyResp sees a zero-length write when the device closes its
+// end, which is the only completion signal a response with neither
+// Content-Length nor chunked encoding ever gets.
+func completePendingCapture(srcAddr []byte) {
+	v, ok := pendingCaptures.Load(string(srcAddr))
+	if !ok {
+		return
+	}
+
+	q := v.(*pendingCaptureQueue)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.entries) > 0 {
+		q.entries = q.entries[1:]
+	}
+}
+
+// responseComplete reports whether resp parses as a complete HTTP response
+// to a request with the given method, used to decide when the oldest
+// pending entry should stop receiving further response chunks and make way
+// for the next queued request. A response with neither Content-Length nor
+// chunked encoding is never judged complete here: bufio/http.ReadResponse
+// would otherwise treat merely having-no-more-bytes-so-far as end of body,
+// which mis-completes a response that's simply still arriving; that case is
+// instead completed explicitly by completePendingCapture on connection close.
+func responseComplete(resp []byte, method string) bool {
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	r, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(resp)), &http.Request{Method: method})
+	if err != nil {
+		return false
+	}
+	defer r.Body.Close()
+
+	if r.ContentLength < 0 && len(r.TransferEncoding) == 0 {
+		// Chunked encoding also leaves ContentLength at -1, but then parses
+		// its own terminator, which io.Copy below still detects correctly.
+		return false
+	}
+
+	_, err = io.Copy(ioutil.Discard, r.Body)
+
+	return err == nil
+}
+
+func getOrCreateCaptureRing(sid string, maxCount, maxBytes int) *captureRing {
+	if v, ok := proxyCaptures.Load(sid); ok {
+		return v.(*captureRing)
+	}
+
+	ring := &captureRing{maxCount: maxCount, maxBytes: maxBytes}
+	actual, _ := proxyCaptures.LoadOrStore(sid, ring)
+
+	return actual.(*captureRing)
+}
+
+func getCaptureRing(sid string) (*captureRing, bool) {
+	v, ok := proxyCaptures.Load(sid)
+	if !ok {
+		return nil, false
+	}
+
+	return v.(*captureRing), true
+}
+
+// recordRequest dumps req (after redacting sensitive headers), appends a new
+// entry to the ring and returns it so the caller can fill in the response as
+// it arrives.
+func (r *captureRing) recordRequest(destAddr string, req *http.Request) *captureEntry {
+	clone := req.Clone(req.Context())
+	for _, h := range redactedHeaders {
+		clone.Header.Del(h)
+	}
+
+	dump, _ := httputil.DumpRequest(clone, true)
+
+	entry := &captureEntry{DestAddr: destAddr, Time: time.Now(), Req: dump, reqMethod: req.Method, ring: r}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry.Index = r.nextIndex
+	r.nextIndex++
+
+	r.entries = append(r.entries, entry)
+	r.totalBytes += len(entry.Req)
+
+	r.evictLocked()
+
+	return entry
+}
+
+// appendResponse appends raw bytes written back to the client for this
+// entry. Response bytes arrive from the device as opaque chunks, so unlike
+// the request side they aren't parsed/redacted, only size-bounded. Once the
+// ring has evicted this entry it no longer counts toward r.totalBytes, so
+// further chunks are kept on the dangling entry without touching the ring.
+func (e *captureEntry) appendResponse(data []byte) {
+	r := e.ring
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if e.evicted {
+		e.Resp = append(e.Resp, data...)
+		return
+	}
+
+	e.Resp = append(e.Resp, data...)
+	r.totalBytes += len(data)
+
+	r.evictLocked()
+}
+
+func (r *captureRing) evictLocked() {
+	for (r.maxCount > 0 && len(r.entries) > r.maxCount) || (r.maxBytes > 0 && r.totalBytes > r.maxBytes) {
+		if len(r.entries) == 0 {
+			break
+		}
+
+		oldest := r.entries[0]
+		r.totalBytes -= len(oldest.Req) + len(oldest.Resp)
+		oldest.evicted = true
+		r.entries = r.entries[1:]
+	}
+}
+
+// snapshotLocked copies e's Req/Resp slices so callers can read them after
+// releasing r.mu without racing appendResponse, which mutates e.Resp under
+// that same lock.
+func (e *captureEntry) snapshotLocked() *captureEntry {
+	cp := *e
+	cp.Req = append([]byte(nil), e.Req...)
+	cp.Resp = append([]byte(nil), e.Resp...)
+
+	return &cp
+}
+
+func (r *captureRing) list() []*captureEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out := make([]*captureEntry, len(r.entries))
+	for i, e := range r.entries {
+		out[i] = e.snapshotLocked()
+	}
+
+	return out
+}
+
+func (r *captureRing) get(idx int) (*captureEntry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, e := range r.entries {
+		if e.Index == idx {
+			return e.snapshotLocked(), true
+		}
+	}
+
+	return nil, false
+}
+
+func listCapturesHandler(c *gin.Context) {
+	sid := c.Param("sid")
+
+	ring, ok := getCaptureRing(sid)
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	c.JSON(http.StatusOK, ring.list())
+}
+
+func getCaptureHandler(c *gin.Context) {
+	sid := c.Param("sid")
+
+	idx, err := strconv.Atoi(c.Param("idx"))
+	if err != nil {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	ring, ok := getCaptureRing(sid)
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	entry, ok := ring.get(idx)
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"index":    entry.Index,
+		"destAddr": entry.DestAddr,
+		"time":     entry.Time,
+		"request":  string(entry.Req),
+		"response": string(entry.Resp),
+	})
+}
+
+// replayCaptureHandler re-sends a previously captured request through the
+// same HttpProxyWriter addressing the original session used. The response,
+// if any, will only reach a client if the original session's connection is
+// still registered in httpProxyCons.
+func replayCaptureHandler(brk *broker, c *gin.Context) {
+	sid := c.Param("sid")
+
+	idx, err := strconv.Atoi(c.Param("idx"))
+	if err != nil {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	ring, ok := getCaptureRing(sid)
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	entry, ok := ring.get(idx)
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	v, ok := httpProxyWriters.Load(sid)
+	if !ok {
+		c.Status(http.StatusGone)
+		return
+	}
+
+	hpw := v.(*HttpProxyWriter)
+	hpw.Write(entry.Req)
+
+	c.JSON(http.StatusOK, gin.H{"devid": hpw.dev.id, "replayed": entry.Index})
+}
+
+// RegisterCaptureRoutes wires the capture/replay REST API onto the gin
+// router that also serves httpProxyRedirect, gated by cfg.HttpProxyCapture
+// the same way doHttpProxy only populates a captureRing when it's enabled.
+func RegisterCaptureRoutes(r gin.IRouter, brk *broker) {
+	if !brk.cfg.HttpProxyCapture {
+		return
+	}
+
+	r.GET("/proxy/capture/:sid", listCapturesHandler)
+	r.GET("/proxy/capture/:sid/:idx", getCaptureHandler)
+	r.POST("/proxy/capture/:sid/:idx/replay", func(c *gin.Context) {
+		replayCaptureHandler(brk, c)
+	})
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"container/list"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	caCertValidYears = 10
+	leafCertValidDur = 365 * 24 * time.Hour
+	certCacheMaxSize = 1024
+)
+
+// certCache is a bounded LRU cache of leaf certificates keyed by hostname.
+type certCache struct {
+	mu       sync.Mutex
+	capacity int
+	items    map[string]*list.Element
+	order    *list.List
+}
+
+type certCacheEntry struct {
+	host string
+	cert *tls.Certificate
+}
+
+func newCertCache(capacity int) *certCache {
+	return &certCache{
+		capacity: capacity,
+		items:    make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (cc *certCache) get(host string) (*tls.Certificate, bool) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	elem, ok := cc.items[host]
+	if !ok {
+		return nil, false
+	}
+
+	cc.order.MoveToFront(elem)
+
+	return elem.Value.(*certCacheEntry).cert, true
+}
+
+func (cc *certCache) put(host string, cert *tls.Certificate) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if elem, ok := cc.items[host]; ok {
+		elem.Value.(*certCacheEntry).cert = cert
+		cc.order.MoveToFront(elem)
+		return
+	}
+
+	elem := cc.order.PushFront(&certCacheEntry{host, cert})
+	cc.items[host] = elem
+
+	for cc.order.Len() > cc.capacity {
+		oldest := cc.order.Back()
+		if oldest == nil {
+			break
+		}
+
+		cc.order.Remove(oldest)
+		delete(cc.items, oldest.Value.(*certCacheEntry).host)
+	}
+}
+
+// mitmCA is the long-lived CA keypair used to mint per-host leaf
+// certificates for the HTTP proxy's TLS listener.
+type mitmCA struct {
+	cert  *x509.Certificate
+	key   *ecdsa.PrivateKey
+	raw   []byte // DER encoding of cert, served PEM-encoded at /ca.crt
+	cache *certCache
+}
+
+func genRandSerial() (*big.Int, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
+
+func loadOrCreateCA(certPath, keyPath string) (*mitmCA, error) {
+	certPEM, certErr := ioutil.ReadFile(certPath)
+	keyPEM, keyErr := ioutil.ReadFile(keyPath)
+
+	if certErr == nil && keyErr == nil {
+		certBlock, _ := pem.Decode(certPEM)
+		keyBlock, _ := pem.Decode(keyPEM)
+		if certBlock == nil || keyBlock == nil {
+			return nil, errors.New("invalid CA cert or key pem")
+		}
+
+		cert, err := x509.ParseCertificate(certBlock.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		return &mitmCA{cert, key, certBlock.Bytes, newCertCache(certCacheMaxSize)}, nil
+	}
+
+	log.Info().Msg("generating new http proxy CA")
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := genRandSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "rttys http proxy CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().AddDate(caCertValidYears, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return nil, err
+	}
+
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mitmCA{cert, key, der, newCertCache(certCacheMaxSize)}, nil
+}
+
+// issueLeaf mints (or returns a cached) leaf certificate for host, which may
+// be a DNS name or a literal IP address.
+func (ca *mitmCA) issueLeaf(host string) (*tls.Certificate, error) {
+	if cert, ok := ca.cache.get(host); ok {
+		return cert, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := genRandSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(leafCertValidDur),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, ca.raw},
+		PrivateKey:  key,
+	}
+
+	ca.cache.put(host, cert)
+
+	return cert, nil
+}
+
+// pendingDestAddr remembers the rtty-http-destaddr value httpProxyRedirect
+// handed a client, keyed by that client's IP, so getCertificate can honor it
+// when the TLS handshake that follows carries no SNI.
+var pendingDestAddr sync.Map // client IP -> destaddr
+
+func rememberPendingDestAddr(clientIP, addr string) {
+	pendingDestAddr.Store(clientIP, addr)
+}
+
+// getCertificate is installed as tls.Config.GetCertificate on the proxy
+// listener. It mints a leaf certificate for the SNI name; when the client
+// didn't send SNI, it falls back to the rtty-http-destaddr value recorded
+// for that client's IP by httpProxyRedirect (the cookie itself isn't
+// readable until after the handshake, but the redirect that set it came
+// from the same client just before it opened this connection).
+func (ca *mitmCA) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := hello.ServerName
+
+	if host == "" && hello.Conn != nil {
+		if tcpAddr, ok := hello.Conn.RemoteAddr().(*net.TCPAddr); ok {
+			ip := tcpAddr.IP.String()
+
+			if v, ok := pendingDestAddr.Load(ip); ok {
+				// One-shot: consume it so a later, unrelated no-SNI
+				// connection from the same IP doesn't get mis-certed with
+				// a stale destaddr, and so the map doesn't grow unbounded.
+				pendingDestAddr.Delete(ip)
+
+				if h, _, err := net.SplitHostPort(v.(string)); err == nil {
+					host = h
+				} else {
+					host = v.(string)
+				}
+			}
+		}
+	}
+
+	if host == "" {
+		host = ca.cert.Subject.CommonName
+	}
+
+	return ca.issueLeaf(host)
+}
+
+func caCertHandler(ca *mitmCA, c *gin.Context) {
+	c.Header("Content-Disposition", "attachment; filename=rttys-ca.crt")
+	c.Data(http.StatusOK, "application/x-x509-ca-cert", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.raw}))
+}
+
+// RegisterCaCertRoute wires the CA certificate download endpoint onto the
+// gin router that also serves httpProxyRedirect, so clients can fetch and
+// trust the MITM CA before hitting the dynamically-certed proxy listener.
+func RegisterCaCertRoute(r gin.IRouter, brk *broker) {
+	r.GET("/ca.crt", func(c *gin.Context) {
+		if brk.proxyCA == nil {
+			c.Status(http.StatusNotFound)
+			return
+		}
+
+		caCertHandler(brk.proxyCA, c)
+	})
+}
@@ -34,9 +34,15 @@ type httpReq struct {
 
 var httpProxyCons sync.Map
 var httpProxySessions sync.Map
+var httpProxyWriters sync.Map // sid -> *HttpProxyWriter, used by the capture replay API
 
 func handleHttpProxyResp(resp *httpResp) {
 	data := resp.data
+
+	// The response frame is always keyed by the fixed 18-byte src addr
+	// regardless of dev.proto: the dest-addr TLV versioning only affects
+	// how a request is addressed to the device, not how its reply is
+	// routed back to the original client connection.
 	addr := data[:18]
 	data = data[18:]
 
@@ -44,24 +50,71 @@ func handleHttpProxyResp(resp *httpResp) {
 		if c, ok := cons.(*sync.Map).Load(string(addr)); ok {
 			c := c.(net.Conn)
 			if len(data) == 0 {
+				// A zero-length write signals the device closed its end,
+				// which is the only completion signal a connection-close-
+				// delimited response (no Content-Length, not chunked) ever
+				// gets; without this, responseComplete would never pop it.
+				completePendingCapture(addr)
 				c.Close()
 			} else {
 				c.Write(data)
+				recordResponse(addr, data)
 			}
 		}
 	}
 }
 
-func genDestAddr(addr string) []byte {
-	destIP, destPort, err := httpProxyVaildAddr(addr)
+// protoDestAddrTLV is the dev.proto version from which a device understands
+// the versioned dest-addr TLV (type, length-prefixed addr, port) instead of
+// the legacy fixed 6-byte IPv4+port frame.
+const protoDestAddrTLV = 5
+
+const (
+	addrTypeIPv4   = 1
+	addrTypeDomain = 3
+	addrTypeIPv6   = 4
+)
+
+// genDestAddr encodes addr for the wire, using the legacy fixed-size IPv4
+// frame for devices that haven't been upgraded (proto < protoDestAddrTLV)
+// and the versioned TLV otherwise. It returns nil if addr can't be encoded
+// for the given protocol version, e.g. an IPv6/hostname addr for an old
+// device that only understands the legacy IPv4 frame.
+func genDestAddr(addr string, proto int) []byte {
+	da, err := httpProxyVaildAddr(addr)
 	if err != nil {
 		return nil
 	}
 
-	b := make([]byte, 6)
-	copy(b, destIP)
+	if proto < protoDestAddrTLV {
+		if da.kind != addrTypeIPv4 {
+			return nil
+		}
+
+		b := make([]byte, 6)
+		copy(b, da.ip.To4())
+		binary.BigEndian.PutUint16(b[4:], da.port)
 
-	binary.BigEndian.PutUint16(b[4:], destPort)
+		return b
+	}
+
+	var addrBytes []byte
+	switch da.kind {
+	case addrTypeIPv4:
+		addrBytes = da.ip.To4()
+	case addrTypeIPv6:
+		addrBytes = da.ip.To16()
+	case addrTypeDomain:
+		addrBytes = []byte(da.host)
+	}
+
+	b := make([]byte, 0, 2+len(addrBytes)+2)
+	b = append(b, da.kind, byte(len(addrBytes)))
+	b = append(b, addrBytes...)
+
+	portBytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBytes, da.port)
+	b = append(b, portBytes...)
 
 	return b
 }
@@ -138,6 +191,11 @@ func doHttpProxy(brk *broker, c net.Conn) {
 	}
 	sid := cookie.Value
 
+	v, ok := httpProxyPrincipals.Load(sid)
+	if !ok || !v.(*httpProxyPrincipal).allowed(devid) {
+		return
+	}
+
 	https := false
 	cookie, _ = req.Cookie("rtty-http-proto")
 	if cookie != nil && cookie.Value == "https" {
@@ -150,7 +208,12 @@ func doHttpProxy(brk *broker, c net.Conn) {
 		hostHeaderRewrite, _ = url.QueryUnescape(cookie.Value)
 	}
 
-	destAddr := genDestAddr(hostHeaderRewrite)
+	d := dev.(*device)
+
+	wireDestAddr := genDestAddr(hostHeaderRewrite, d.proto)
+	if wireDestAddr == nil {
+		return
+	}
 	srcAddr := tcpAddr2Bytes(c.RemoteAddr().(*net.TCPAddr))
 
 	if cons, _ := httpProxyCons.LoadOrStore(devid, &sync.Map{}); true {
@@ -173,14 +236,32 @@ func doHttpProxy(brk *broker, c net.Conn) {
 				cons := cons.(*sync.Map)
 				cons.Delete(string(srcAddr))
 			}
+
+			// httpProxyWriters/httpProxyPrincipals are keyed by sid, not by
+			// this connection's srcAddr: a single browsing session opens
+			// many parallel/short-lived proxy connections sharing one sid,
+			// so they must only be torn down when the session itself
+			// rotates (see httpProxyRedirect), not when one of its
+			// connections closes.
+			clearPendingCaptures(srcAddr)
 		}()
 	} else {
 		return
 	}
 
-	hpw := &HttpProxyWriter{destAddr, srcAddr, hostHeaderRewrite, brk, dev.(*device), https}
+	hpw := &HttpProxyWriter{wireDestAddr, srcAddr, hostHeaderRewrite, brk, d, https}
+	httpProxyWriters.Store(sid, hpw)
+
+	var capRing *captureRing
+	cfg := brk.cfg
+	if cfg.HttpProxyCapture {
+		capRing = getOrCreateCaptureRing(sid, cfg.HttpProxyCaptureMax, httpProxyCaptureMaxBytes)
+	}
 
 	req.Host = hostHeaderRewrite
+	if capRing != nil {
+		trackPendingCapture(srcAddr, capRing.recordRequest(hostHeaderRewrite, req))
+	}
 	hpw.WriteRequest(req)
 
 	if req.Header.Get("Upgrade") == "websocket" {
@@ -194,7 +275,7 @@ func doHttpProxy(brk *broker, c net.Conn) {
 			}
 
 			msg := append([]byte{}, srcAddr...)
-			msg = append(msg, destAddr...)
+			msg = append(msg, wireDestAddr...)
 			msg = append(msg, b[:n]...)
 
 			brk.httpReq <- &httpReq{devid, msg}
@@ -207,6 +288,9 @@ func doHttpProxy(brk *broker, c net.Conn) {
 				return
 			}
 
+			if capRing != nil {
+				trackPendingCapture(srcAddr, capRing.recordRequest(hostHeaderRewrite, req))
+			}
 			hpw.WriteRequest(req)
 		}
 	}
@@ -215,6 +299,12 @@ func doHttpProxy(brk *broker, c net.Conn) {
 func listenHttpProxy(brk *broker) {
 	cfg := brk.cfg
 
+	if err := initHttpProxyAuth(cfg.HttpProxyAuth); err != nil {
+		log.Fatal().Msgf("invalid HttpProxyAuth: %s", err.Error())
+	}
+
+	listenSocks5Proxy(brk)
+
 	if cfg.AddrHttpProxy != "" {
 		addr, err := net.ResolveTCPAddr("tcp", cfg.AddrHttpProxy)
 		if err != nil {
@@ -255,6 +345,21 @@ func listenHttpProxy(brk *broker) {
 
 		ln = tls.NewListener(ln, tlsConfig)
 		log.Info().Msgf("Listen http proxy on: %s SSL on", ln.Addr().(*net.TCPAddr))
+	} else if cfg.CaCert != "" && cfg.CaKey != "" {
+		ca, err := loadOrCreateCA(cfg.CaCert, cfg.CaKey)
+		if err != nil {
+			log.Fatal().Msgf("unable to load http proxy CA: %s", err.Error())
+		}
+		brk.proxyCA = ca
+
+		tlsConfig := &tls.Config{}
+		tlsConfig.GetCertificate = ca.getCertificate
+		tlsConfig.Time = time.Now
+		tlsConfig.Rand = rand.Reader
+		tlsConfig.MinVersion = tls.VersionTLS12
+
+		ln = tls.NewListener(ln, tlsConfig)
+		log.Info().Msgf("Listen http proxy on: %s SSL on (dynamic per-host certs)", ln.Addr().(*net.TCPAddr))
 	} else {
 		log.Info().Msgf("Listen http proxy on: %s SSL off", ln.Addr().(*net.TCPAddr))
 	}
@@ -286,26 +391,51 @@ func listenHttpProxy(brk *broker) {
 	}()
 }
 
-func httpProxyVaildAddr(addr string) (net.IP, uint16, error) {
-	ips, ports, err := net.SplitHostPort(addr)
+// destAddr is a validated proxy destination: either a literal IPv4/IPv6
+// address or a hostname, plus a port.
+type destAddr struct {
+	kind byte // addrTypeIPv4, addrTypeIPv6 or addrTypeDomain
+	ip   net.IP
+	host string
+	port uint16
+}
+
+// httpProxyVaildAddr validates addr, accepting an IPv4 literal ("1.2.3.4:80"),
+// a bracketed IPv6 literal ("[::1]:8080") or a hostname ("router.lan:80").
+// The port defaults to 80 when omitted.
+func httpProxyVaildAddr(addr string) (*destAddr, error) {
+	host, ports, err := net.SplitHostPort(addr)
 	if err != nil {
-		ips = addr
+		host = addr
 		ports = "80"
+
+		if len(host) > 1 && host[0] == '[' && host[len(host)-1] == ']' {
+			host = host[1 : len(host)-1]
+		}
 	}
 
-	ip := net.ParseIP(ips)
-	if ip == nil {
-		return nil, 0, errors.New("invalid IPv4 Addr")
+	if host == "" {
+		return nil, errors.New("invalid addr")
 	}
 
-	ip = ip.To4()
-	if ip == nil {
-		return nil, 0, errors.New("invalid IPv4 Addr")
+	port, err := strconv.Atoi(ports)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, errors.New("invalid port")
 	}
 
-	port, _ := strconv.Atoi(ports)
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return &destAddr{kind: addrTypeIPv4, ip: ip4, port: uint16(port)}, nil
+		}
+
+		return &destAddr{kind: addrTypeIPv6, ip: ip.To16(), port: uint16(port)}, nil
+	}
 
-	return ip, uint16(port), nil
+	if len(host) > 255 {
+		return nil, errors.New("invalid hostname")
+	}
+
+	return &destAddr{kind: addrTypeDomain, host: host, port: uint16(port)}, nil
 }
 
 func httpProxyRedirect(br *broker, c *gin.Context) {
@@ -315,7 +445,7 @@ func httpProxyRedirect(br *broker, c *gin.Context) {
 	addr := c.Param("addr")
 	rawPath := c.Param("path")
 
-	_, _, err := httpProxyVaildAddr(addr)
+	_, err := httpProxyVaildAddr(addr)
 	if err != nil {
 		c.Status(http.StatusBadRequest)
 		return
@@ -333,6 +463,16 @@ func httpProxyRedirect(br *broker, c *gin.Context) {
 		return
 	}
 
+	principal, ok := httpProxyAuth.Authenticate(c)
+	if !ok {
+		return // Authenticate already wrote the challenge/error response
+	}
+
+	if !principal.allowed(devid) {
+		c.Status(http.StatusForbidden)
+		return
+	}
+
 	location := cfg.HttpProxyRedirURL
 
 	if location == "" {
@@ -364,17 +504,22 @@ func httpProxyRedirect(br *broker, c *gin.Context) {
 		if v, ok := httpProxySessions.Load(sid); ok {
 			close(v.(chan struct{}))
 			httpProxySessions.Delete(sid)
+			httpProxyPrincipals.Delete(sid)
+			httpProxyWriters.Delete(sid)
 		}
 	}
 
 	sid = utils.GenUniqueID("http-proxy")
 
 	httpProxySessions.Store(sid, make(chan struct{}))
+	httpProxyPrincipals.Store(sid, principal)
 
 	c.SetCookie("rtty-http-sid", sid, 0, "", "", false, true)
 	c.SetCookie("rtty-http-devid", devid, 0, "", "", false, true)
 	c.SetCookie("rtty-http-proto", proto, 0, "", "", false, true)
 	c.SetCookie("rtty-http-destaddr", addr, 0, "", "", false, true)
 
+	rememberPendingDestAddr(c.ClientIP(), addr)
+
 	c.Redirect(http.StatusFound, location)
 }
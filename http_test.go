@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestGenDestAddr(t *testing.T) {
+	tests := []struct {
+		name  string
+		addr  string
+		proto int
+		want  []byte // nil means genDestAddr must return nil
+	}{
+		{
+			name:  "legacy proto, ipv4",
+			addr:  "1.2.3.4:8080",
+			proto: protoDestAddrTLV - 1,
+			want:  legacyFrame(t, "1.2.3.4", 8080),
+		},
+		{
+			name:  "legacy proto, ipv6 unsupported",
+			addr:  "[::1]:8080",
+			proto: protoDestAddrTLV - 1,
+			want:  nil,
+		},
+		{
+			name:  "legacy proto, hostname unsupported",
+			addr:  "router.lan:80",
+			proto: protoDestAddrTLV - 1,
+			want:  nil,
+		},
+		{
+			name:  "TLV proto, ipv4",
+			addr:  "1.2.3.4:8080",
+			proto: protoDestAddrTLV,
+			want:  tlvFrame(t, addrTypeIPv4, net.ParseIP("1.2.3.4").To4(), 8080),
+		},
+		{
+			name:  "TLV proto, ipv6",
+			addr:  "[::1]:8080",
+			proto: protoDestAddrTLV,
+			want:  tlvFrame(t, addrTypeIPv6, net.ParseIP("::1").To16(), 8080),
+		},
+		{
+			name:  "TLV proto, hostname",
+			addr:  "router.lan:80",
+			proto: protoDestAddrTLV,
+			want:  tlvFrame(t, addrTypeDomain, []byte("router.lan"), 80),
+		},
+		{
+			name:  "TLV proto, newer than protoDestAddrTLV",
+			addr:  "1.2.3.4:443",
+			proto: protoDestAddrTLV + 1,
+			want:  tlvFrame(t, addrTypeIPv4, net.ParseIP("1.2.3.4").To4(), 443),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := genDestAddr(tt.addr, tt.proto)
+
+			if tt.want == nil {
+				if got != nil {
+					t.Fatalf("genDestAddr(%q, %d) = % x, want nil", tt.addr, tt.proto, got)
+				}
+				return
+			}
+
+			if string(got) != string(tt.want) {
+				t.Fatalf("genDestAddr(%q, %d) = % x, want % x", tt.addr, tt.proto, got, tt.want)
+			}
+		})
+	}
+}
+
+func legacyFrame(t *testing.T, ip string, port uint16) []byte {
+	t.Helper()
+
+	b := make([]byte, 6)
+	copy(b, net.ParseIP(ip).To4())
+	binary.BigEndian.PutUint16(b[4:], port)
+
+	return b
+}
+
+func tlvFrame(t *testing.T, kind byte, addr []byte, port uint16) []byte {
+	t.Helper()
+
+	b := make([]byte, 0, 2+len(addr)+2)
+	b = append(b, kind, byte(len(addr)))
+	b = append(b, addr...)
+
+	portBytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBytes, port)
+
+	return append(b, portBytes...)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// SOCKS5 protocol constants (RFC 1928 / RFC 1929).
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone         = 0x00
+	socks5AuthUserPass     = 0x02
+	socks5AuthNoAcceptable = 0xff
+
+	socks5CmdConnect = 0x01
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5RepSucceeded      = 0x00
+	socks5RepGeneralFail    = 0x01
+	socks5RepCmdNotSupport  = 0x07
+	socks5RepAddrNotSupport = 0x08
+
+	socks5UserPassVersion = 0x01
+)
+
+func listenSocks5Proxy(brk *broker) {
+	cfg := brk.cfg
+
+	if cfg.AddrSocks5Proxy == "" {
+		return
+	}
+
+	ln, err := net.Listen("tcp", cfg.AddrSocks5Proxy)
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+
+	log.Info().Msgf("Listen socks5 proxy on: %s", ln.Addr().(*net.TCPAddr))
+
+	go func() {
+		defer ln.Close()
+
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				log.Error().Msg(err.Error())
+				continue
+			}
+
+			go doSocks5Proxy(brk, c)
+		}
+	}()
+}
+
+func doSocks5Proxy(brk *broker, c net.Conn) {
+	defer c.Close()
+
+	devid, principal, err := socks5Handshake(c)
+	if err != nil {
+		log.Debug().Msgf("socks5 handshake failed: %s", err.Error())
+		return
+	}
+
+	dev, ok := brk.devices[devid]
+	if !ok {
+		socks5Reply(c, socks5RepGeneralFail, nil)
+		return
+	}
+
+	d := dev.(*device)
+
+	addr, err := socks5ReadRequest(c)
+	if err != nil {
+		log.Debug().Msgf("socks5 request failed: %s", err.Error())
+		return
+	}
+
+	wireDestAddr := genDestAddr(addr, d.proto)
+	if wireDestAddr == nil {
+		socks5Reply(c, socks5RepAddrNotSupport, nil)
+		return
+	}
+
+	srcAddr := tcpAddr2Bytes(c.RemoteAddr().(*net.TCPAddr))
+
+	if cons, _ := httpProxyCons.LoadOrStore(devid, &sync.Map{}); true {
+		cons := cons.(*sync.Map)
+		cons.Store(string(srcAddr), c)
+	}
+	defer func() {
+		if cons, ok := httpProxyCons.Load(devid); ok {
+			cons.(*sync.Map).Delete(string(srcAddr))
+		}
+	}()
+
+	socks5Reply(c, socks5RepSucceeded, nil)
+
+	log.Debug().Msgf("socks5 proxy: %s -> %s (%s)", principal.name, devid, addr)
+
+	hpw := &HttpProxyWriter{wireDestAddr, srcAddr, "", brk, d, false}
+
+	b := make([]byte, 4096)
+	for {
+		n, err := c.Read(b)
+		if err != nil {
+			return
+		}
+
+		hpw.Write(b[:n])
+	}
+}
+
+// socks5Handshake performs the method negotiation, always selecting
+// username/password auth; a client that does not offer it (e.g. NO_AUTH
+// only) is rejected. It then extracts the devid encoded in the username and
+// authenticates it against httpProxyAuth, enforcing the resolved principal's
+// ACL.
+func socks5Handshake(c net.Conn) (devid string, principal *httpProxyPrincipal, err error) {
+	hdr := make([]byte, 2)
+	if _, err = io.ReadFull(c, hdr); err != nil {
+		return "", nil, err
+	}
+
+	if hdr[0] != socks5Version {
+		return "", nil, errors.New("unsupported socks version")
+	}
+
+	nmethods := int(hdr[1])
+	methods := make([]byte, nmethods)
+	if _, err = io.ReadFull(c, methods); err != nil {
+		return "", nil, err
+	}
+
+	wantUserPass := false
+	for _, m := range methods {
+		if m == socks5AuthUserPass {
+			wantUserPass = true
+		}
+	}
+
+	if !wantUserPass {
+		c.Write([]byte{socks5Version, socks5AuthNoAcceptable})
+		return "", nil, errors.New("client doesn't support username/password auth")
+	}
+
+	c.Write([]byte{socks5Version, socks5AuthUserPass})
+
+	return socks5ReadUserPass(c)
+}
+
+func socks5ReadUserPass(c net.Conn) (devid string, principal *httpProxyPrincipal, err error) {
+	hdr := make([]byte, 2)
+	if _, err = io.ReadFull(c, hdr); err != nil {
+		return "", nil, err
+	}
+
+	if hdr[0] != socks5UserPassVersion {
+		return "", nil, errors.New("unsupported username/password auth version")
+	}
+
+	ulen := int(hdr[1])
+	user := make([]byte, ulen)
+	if _, err = io.ReadFull(c, user); err != nil {
+		return "", nil, err
+	}
+
+	plen := make([]byte, 1)
+	if _, err = io.ReadFull(c, plen); err != nil {
+		return "", nil, err
+	}
+
+	pass := make([]byte, int(plen[0]))
+	if _, err = io.ReadFull(c, pass); err != nil {
+		return "", nil, err
+	}
+
+	devid = string(user)
+	if idx := strings.IndexByte(devid, ':'); idx >= 0 {
+		devid = devid[:idx]
+	}
+
+	if devid == "" {
+		c.Write([]byte{socks5UserPassVersion, 0x01})
+		return "", nil, errors.New("empty devid in socks5 username")
+	}
+
+	principal, ok := httpProxyAuth.AuthenticateToken(devid, string(pass))
+	if !ok || !principal.allowed(devid) {
+		c.Write([]byte{socks5UserPassVersion, 0x01})
+		return "", nil, errors.New("socks5 auth rejected for devid " + devid)
+	}
+
+	c.Write([]byte{socks5UserPassVersion, 0x00})
+
+	return devid, principal, nil
+}
+
+// socks5ReadRequest reads the CONNECT request and returns the dest addr as
+// a "host:port" string, for genDestAddr to encode in whatever wire format
+// the target device's proto understands. Only IPv4 CONNECT is supported
+// for now.
+func socks5ReadRequest(c net.Conn) (string, error) {
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(c, hdr); err != nil {
+		return "", err
+	}
+
+	if hdr[0] != socks5Version {
+		return "", errors.New("unsupported socks version")
+	}
+
+	if hdr[1] != socks5CmdConnect {
+		socks5Reply(c, socks5RepCmdNotSupport, nil)
+		return "", errors.New("only CONNECT is supported")
+	}
+
+	switch hdr[3] {
+	case socks5AddrIPv4:
+		raw := make([]byte, 4+2)
+		if _, err := io.ReadFull(c, raw); err != nil {
+			return "", err
+		}
+
+		ip := net.IP(raw[:4])
+		port := binary.BigEndian.Uint16(raw[4:])
+
+		return fmt.Sprintf("%s:%d", ip.String(), port), nil
+	case socks5AddrIPv6, socks5AddrDomain:
+		socks5Reply(c, socks5RepAddrNotSupport, nil)
+		return "", errors.New("IPv6/DOMAINNAME CONNECT not implemented yet")
+	default:
+		socks5Reply(c, socks5RepAddrNotSupport, nil)
+		return "", errors.New("unknown socks5 address type")
+	}
+}
+
+func socks5Reply(c net.Conn, rep byte, bnd net.Addr) {
+	reply := []byte{socks5Version, rep, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0}
+	c.Write(reply)
+}